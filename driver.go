@@ -0,0 +1,393 @@
+package pgmigrate
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/wttw/pgmigrate/internal/sqlshared"
+)
+
+// Driver executes the database operations a Migrator needs, decoupling
+// pgmigrate from pgx so that other PostgreSQL client libraries can be used.
+// Up, Down, To, Apply, Current, History and Verify all dispatch through a
+// Driver - the Conn-based methods build a pgx-backed Driver internally, so
+// there is a single implementation of the migration logic regardless of
+// which one a caller uses. See drivers/pgx and drivers/stdlib for Driver
+// implementations wrapping other client libraries, passed to
+// UpDriver/DownDriver/ToDriver/ApplyDriver instead of Up/Down/To/Apply.
+//
+// Go-based migrations registered with RegisterGo need a pgx.Tx, so only the
+// built-in pgx-backed Driver used by the Conn-based methods supports them;
+// other Drivers return an error if a Go-based migration is due.
+type Driver interface {
+	// AcquireLock blocks until the advisory lock identified by key is
+	// held, and returns a Driver pinned to the single connection/session
+	// that now holds it. Every later call for this run - EnsureVersionTable,
+	// CurrentVersion, History, Apply, and eventually ReleaseLock - must go
+	// through the returned Driver, not the original: advisory locks are
+	// session-scoped, so spreading calls across a pool's connections would
+	// silently break them.
+	AcquireLock(ctx context.Context, key int64) (Driver, error)
+	// ReleaseLock releases a lock acquired by AcquireLock. It must be
+	// called on the Driver AcquireLock returned.
+	ReleaseLock(ctx context.Context, key int64) error
+	// EnsureVersionTable creates table if it doesn't already exist, using
+	// the single-row layout or, in HistoryMode, the append-only layout.
+	EnsureVersionTable(ctx context.Context, table string, historyMode bool) error
+	// CurrentVersion returns the schema version currently recorded in table.
+	CurrentVersion(ctx context.Context, table string, historyMode bool) (int, error)
+	// History returns every row of table, oldest first. Only called when
+	// historyMode is true.
+	History(ctx context.Context, table string) ([]AppliedMigration, error)
+	// Apply runs mig's already-rendered statements (split into one entry
+	// per statement if the migration used "-- pgmigrate:split") against
+	// table, checking that the version currently recorded there is before
+	// and recording it as after once done. Unless noTx is true, this
+	// happens atomically in one transaction; when true (required for
+	// statements such as CREATE INDEX CONCURRENTLY), the statements run
+	// outside any transaction and the version bump is recorded in a second
+	// short transaction once they succeed.
+	Apply(ctx context.Context, table string, historyMode bool, before, after int, mig Migration, statements []string, noTx bool, direction, checksum string) error
+}
+
+// goDriver is implemented by Drivers able to run Go-based migrations
+// registered with RegisterGo, which need a pgx.Tx. Only the built-in
+// pgx-backed Driver behind Up/Down/To/Apply implements this; Drivers from
+// drivers/pgx and drivers/stdlib don't, so applying a Go-based migration
+// through them reports an error instead.
+type goDriver interface {
+	applyGo(ctx context.Context, table string, historyMode bool, before, after int, mig Migration, direction string) error
+}
+
+// UpDriver updates the database schema to the newest version using d,
+// instead of a pgx Conn. See Up for the pgx-backed equivalent - both share
+// this same implementation.
+func (m Migrator) UpDriver(ctx context.Context, d Driver) error {
+	locked, err := d.AcquireLock(ctx, m.lockKey())
+	if err != nil {
+		return fmt.Errorf("while acquiring advisory lock: %w", err)
+	}
+	defer func() { _ = locked.ReleaseLock(ctx, m.lockKey()) }()
+	return m.upDriver(ctx, locked)
+}
+
+func (m Migrator) upDriver(ctx context.Context, d Driver) error {
+	return m.upDriverTo(ctx, d, m.Latest())
+}
+
+// upDriverTo applies up migrations through d until the schema reaches
+// target (m.Latest() when called from upDriver). It's also used by ToDriver when
+// moving forward, so there's one up-loop implementation - and one place that
+// runs the HistoryMode drift check before applying anything.
+func (m Migrator) upDriverTo(ctx context.Context, d Driver, target int) error {
+	if m.HistoryMode {
+		if err := m.verifyDriver(ctx, d); err != nil {
+			return err
+		}
+	}
+	if err := d.EnsureVersionTable(ctx, m.VersionTable, m.HistoryMode); err != nil {
+		return err
+	}
+	current, err := d.CurrentVersion(ctx, m.VersionTable, m.HistoryMode)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve current schema version: %w", err)
+	}
+	for _, v := range m.MigrateUp {
+		if current >= v.Version {
+			continue
+		}
+		if v.Version > target {
+			break
+		}
+		if err := m.applyDriver(ctx, d, current, v.Version, v); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", v.displayName(), err)
+		}
+		current = v.Version
+	}
+	return nil
+}
+
+// DownDriver rolls the database schema back to target using d, instead of a
+// pgx Conn. See Down for the pgx-backed equivalent - both share this same
+// implementation.
+func (m Migrator) DownDriver(ctx context.Context, d Driver, target int) error {
+	locked, err := d.AcquireLock(ctx, m.lockKey())
+	if err != nil {
+		return fmt.Errorf("while acquiring advisory lock: %w", err)
+	}
+	defer func() { _ = locked.ReleaseLock(ctx, m.lockKey()) }()
+	return m.downDriver(ctx, locked, target)
+}
+
+func (m Migrator) downDriver(ctx context.Context, d Driver, target int) error {
+	if err := d.EnsureVersionTable(ctx, m.VersionTable, m.HistoryMode); err != nil {
+		return err
+	}
+	current, err := d.CurrentVersion(ctx, m.VersionTable, m.HistoryMode)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve current schema version: %w", err)
+	}
+	for i := len(m.MigrateDown) - 1; i >= 0; i-- {
+		v := m.MigrateDown[i]
+		if v.Version > current {
+			continue
+		}
+		if v.Version <= target {
+			break
+		}
+		if err := m.applyDriver(ctx, d, current, v.Version-1, v); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", v.displayName(), err)
+		}
+		current = v.Version - 1
+	}
+	return nil
+}
+
+// ToDriver migrates the database schema to target using d, instead of a pgx
+// Conn. See To for the pgx-backed equivalent - both share this same
+// implementation.
+func (m Migrator) ToDriver(ctx context.Context, d Driver, target int) error {
+	locked, err := d.AcquireLock(ctx, m.lockKey())
+	if err != nil {
+		return fmt.Errorf("while acquiring advisory lock: %w", err)
+	}
+	defer func() { _ = locked.ReleaseLock(ctx, m.lockKey()) }()
+
+	current, err := m.currentDriver(ctx, locked)
+	if err != nil {
+		return err
+	}
+	if target == current {
+		return nil
+	}
+	if target < current {
+		return m.downDriver(ctx, locked, target)
+	}
+	// Delegate to upDriverTo rather than looping here directly, so a HistoryMode
+	// run gets the same checksum-drift check m.Up would have performed for the
+	// identical set of migrations.
+	return m.upDriverTo(ctx, locked, target)
+}
+
+// ApplyDriver applies a single migration via d, instead of a pgx Conn. See
+// Apply for the pgx-backed equivalent - both share this same implementation,
+// including running the Hooks around it.
+func (m Migrator) ApplyDriver(ctx context.Context, d Driver, before, after int, mig Migration) error {
+	return m.applyDriver(ctx, d, before, after, mig)
+}
+
+func (m Migrator) applyDriver(ctx context.Context, d Driver, before, after int, mig Migration) error {
+	direction := "up"
+	if after < before {
+		direction = "down"
+	}
+	if m.Hooks.BeforeApply != nil {
+		if err := m.Hooks.BeforeApply(mig, direction); err != nil {
+			return fmt.Errorf("migration %s blocked by BeforeApply hook: %w", mig.displayName(), err)
+		}
+	}
+	start := time.Now()
+	err := m.applyMigrationDriver(ctx, d, before, after, mig, direction)
+	if m.Hooks.AfterApply != nil {
+		m.Hooks.AfterApply(mig, direction, time.Since(start), err)
+	}
+	return err
+}
+
+func (m Migrator) applyMigrationDriver(ctx context.Context, d Driver, before, after int, mig Migration, direction string) error {
+	if mig.Go != nil {
+		gd, ok := d.(goDriver)
+		if !ok {
+			return fmt.Errorf("while applying %s: Go-based migrations need the built-in pgx driver (Up/Down/To/Apply with a Conn), not %T", mig.displayName(), d)
+		}
+		if err := gd.applyGo(ctx, m.VersionTable, m.HistoryMode, before, after, mig, direction); err != nil {
+			return fmt.Errorf("while applying %s: %w", mig.displayName(), err)
+		}
+		return nil
+	}
+
+	raw, err := fs.ReadFile(m.Filesystem, mig.Filename)
+	if err != nil {
+		return fmt.Errorf("while reading patch file: %w", err)
+	}
+	noTx, split := parseDirectives(raw)
+	noTx = noTx || m.Options.DisableTx
+	sql, err := m.renderTemplate(mig, raw)
+	if err != nil {
+		return fmt.Errorf("while rendering %s: %w", mig.displayName(), err)
+	}
+	if m.Hooks.OnSQL != nil {
+		m.Hooks.OnSQL(mig, string(sql))
+	}
+	checksum := checksumOf(mig, raw)
+
+	statements := []string{string(sql)}
+	if split {
+		statements = nil
+		for _, stmt := range strings.Split(string(sql), ";") {
+			stmt = strings.TrimSpace(stmt)
+			if stmt == "" {
+				continue
+			}
+			statements = append(statements, stmt)
+		}
+	}
+
+	if err := d.Apply(ctx, m.VersionTable, m.HistoryMode, before, after, mig, statements, noTx, direction, checksum); err != nil {
+		return fmt.Errorf("while applying %s: %w", mig.displayName(), err)
+	}
+	return nil
+}
+
+func (m Migrator) currentDriver(ctx context.Context, d Driver) (int, error) {
+	if err := d.EnsureVersionTable(ctx, m.VersionTable, m.HistoryMode); err != nil {
+		return 0, err
+	}
+	current, err := d.CurrentVersion(ctx, m.VersionTable, m.HistoryMode)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve current schema version: %w", err)
+	}
+	return current, nil
+}
+
+func (m Migrator) historyDriver(ctx context.Context, d Driver) ([]AppliedMigration, error) {
+	if !m.HistoryMode {
+		return nil, fmt.Errorf("migration history is only recorded in HistoryMode")
+	}
+	if err := d.EnsureVersionTable(ctx, m.VersionTable, m.HistoryMode); err != nil {
+		return nil, err
+	}
+	history, err := d.History(ctx, m.VersionTable)
+	if err != nil {
+		return nil, fmt.Errorf("while reading migration history: %w", err)
+	}
+	return history, nil
+}
+
+func (m Migrator) verifyDriver(ctx context.Context, d Driver) error {
+	if !m.HistoryMode {
+		return nil
+	}
+	history, err := m.historyDriver(ctx, d)
+	if err != nil {
+		return err
+	}
+	applied := map[int]AppliedMigration{}
+	for _, h := range history {
+		if h.Direction == "up" {
+			applied[h.MigrationVersion] = h
+		} else {
+			delete(applied, h.MigrationVersion)
+		}
+	}
+	for _, v := range m.MigrateUp {
+		a, ok := applied[v.Version]
+		if !ok {
+			continue
+		}
+		var sql []byte
+		if v.Go == nil {
+			sql, err = fs.ReadFile(m.Filesystem, v.Filename)
+			if err != nil {
+				return fmt.Errorf("while reading patch file: %w", err)
+			}
+		}
+		current := checksumOf(v, sql)
+		if current != a.Checksum {
+			return &ChecksumMismatchError{Version: v.Version, Filename: v.displayName(), Stored: a.Checksum, Current: current}
+		}
+	}
+	return nil
+}
+
+// connDriver is the built-in, pgx-backed Driver behind Up, Down, To, Apply,
+// Current, History and Verify. AcquireLock pins a single pgx connection for
+// the life of a run - advisory locks are session-scoped, and each migration
+// needs a real transaction for safety - and it's the only Driver able to run
+// Go-based migrations, since those need a pgx.Tx.
+type connDriver struct {
+	db Conn
+}
+
+func (d connDriver) AcquireLock(ctx context.Context, key int64) (Driver, error) {
+	tx, err := acquireAdvisoryLock(ctx, d.db, key)
+	if err != nil {
+		return nil, err
+	}
+	return connDriver{db: tx}, nil
+}
+
+// tryAcquireLock is connDriver's non-blocking equivalent of AcquireLock,
+// used by UpTryLock. It isn't part of the Driver interface since it has no
+// Driver-based equivalent yet.
+func (d connDriver) tryAcquireLock(ctx context.Context, key int64) (Driver, bool, error) {
+	tx, ok, err := tryAcquireAdvisoryLock(ctx, d.db, key)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	return connDriver{db: tx}, true, nil
+}
+
+func (d connDriver) ReleaseLock(ctx context.Context, key int64) error {
+	tx, ok := d.db.(pgx.Tx)
+	if !ok {
+		return fmt.Errorf("connDriver: ReleaseLock called without a connection pinned by AcquireLock")
+	}
+	return releaseAdvisoryLock(ctx, tx, key)
+}
+
+// asDB adapts d.db, a pgx Conn (possibly the pgx.Tx AcquireLock pinned), to
+// sqlshared.DB - the version-table bookkeeping and SQL below is shared with
+// drivers/pgx and drivers/stdlib via the sqlshared package, so there's one
+// copy of it rather than three.
+func (d connDriver) asDB() sqlshared.DB {
+	return sqlshared.NewPgxDB(d.db)
+}
+
+func (d connDriver) EnsureVersionTable(ctx context.Context, table string, historyMode bool) error {
+	return sqlshared.EnsureVersionTable(ctx, d.asDB(), table, historyMode)
+}
+
+func (d connDriver) CurrentVersion(ctx context.Context, table string, historyMode bool) (int, error) {
+	return sqlshared.CurrentVersion(ctx, d.asDB(), table, historyMode)
+}
+
+func (d connDriver) History(ctx context.Context, table string) ([]AppliedMigration, error) {
+	rows, err := sqlshared.History(ctx, d.asDB(), table)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]AppliedMigration, len(rows))
+	for i, r := range rows {
+		history[i] = AppliedMigration(r)
+	}
+	return history, nil
+}
+
+func (d connDriver) Apply(ctx context.Context, table string, historyMode bool, before, after int, mig Migration, statements []string, noTx bool, direction, checksum string) error {
+	return sqlshared.Apply(ctx, d.asDB(), table, historyMode, before, after, mig.Version, mig.Filename, statements, noTx, direction, checksum)
+}
+
+func (d connDriver) applyGo(ctx context.Context, table string, historyMode bool, before, after int, mig Migration, direction string) error {
+	start := time.Now()
+	checksum := checksumOf(mig, nil)
+	return pgx.BeginFunc(ctx, d.db, func(tx pgx.Tx) error {
+		sqtx := sqlshared.WrapPgxTx(tx)
+		var current int
+		if err := sqlshared.ReadVersion(ctx, sqtx, table, historyMode, &current); err != nil {
+			return fmt.Errorf("while reading current version: %w", err)
+		}
+		if current != before {
+			return fmt.Errorf("expected current version %d, found %d", before, current)
+		}
+		if err := mig.Go(ctx, tx); err != nil {
+			return err
+		}
+		return sqlshared.RecordVersion(ctx, sqtx, table, historyMode, after, mig.Version, mig.displayName(), direction, checksum, time.Since(start))
+	})
+}
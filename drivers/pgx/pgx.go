@@ -0,0 +1,83 @@
+// Package pgx adapts a pgx connection or pool to the pgmigrate.Driver
+// interface, for callers using Migrator.UpDriver/DownDriver/ToDriver instead
+// of pgmigrate's pgx-specific Up/Down/To methods.
+package pgx
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/wttw/pgmigrate"
+	"github.com/wttw/pgmigrate/internal/sqlshared"
+)
+
+type driver struct {
+	db pgmigrate.Conn
+}
+
+// New returns a pgmigrate.Driver backed by db, which may be a *pgx.Conn or
+// *pgxpool.Pool.
+func New(db pgmigrate.Conn) pgmigrate.Driver {
+	return driver{db: db}
+}
+
+// AcquireLock pins a single connection from db for the life of the run -
+// pg_advisory_lock is session-scoped, so every later call (EnsureVersionTable,
+// CurrentVersion, History, Apply, ReleaseLock) must go through the returned
+// Driver rather than the original, or the lock and unlock could land on two
+// different connections from the pool.
+func (d driver) AcquireLock(ctx context.Context, key int64) (pgmigrate.Driver, error) {
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `select pg_advisory_lock($1)`, key); err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, err
+	}
+	return driver{db: tx}, nil
+}
+
+func (d driver) ReleaseLock(ctx context.Context, key int64) error {
+	tx, ok := d.db.(pgx.Tx)
+	if !ok {
+		return fmt.Errorf("pgx driver: ReleaseLock called without a connection pinned by AcquireLock")
+	}
+	_, err := tx.Exec(ctx, `select pg_advisory_unlock($1)`, key)
+	if cerr := tx.Commit(ctx); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// asDB adapts d.db to sqlshared.DB - the version-table bookkeeping and SQL
+// below is shared with pgmigrate's built-in driver and drivers/stdlib via
+// the sqlshared package, so there's one copy of it rather than three.
+func (d driver) asDB() sqlshared.DB {
+	return sqlshared.NewPgxDB(d.db)
+}
+
+func (d driver) EnsureVersionTable(ctx context.Context, table string, historyMode bool) error {
+	return sqlshared.EnsureVersionTable(ctx, d.asDB(), table, historyMode)
+}
+
+func (d driver) CurrentVersion(ctx context.Context, table string, historyMode bool) (int, error) {
+	return sqlshared.CurrentVersion(ctx, d.asDB(), table, historyMode)
+}
+
+func (d driver) History(ctx context.Context, table string) ([]pgmigrate.AppliedMigration, error) {
+	rows, err := sqlshared.History(ctx, d.asDB(), table)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]pgmigrate.AppliedMigration, len(rows))
+	for i, r := range rows {
+		history[i] = pgmigrate.AppliedMigration(r)
+	}
+	return history, nil
+}
+
+func (d driver) Apply(ctx context.Context, table string, historyMode bool, before, after int, mig pgmigrate.Migration, statements []string, noTx bool, direction, checksum string) error {
+	return sqlshared.Apply(ctx, d.asDB(), table, historyMode, before, after, mig.Version, mig.Filename, statements, noTx, direction, checksum)
+}
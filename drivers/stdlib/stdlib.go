@@ -0,0 +1,83 @@
+// Package stdlib adapts a database/sql connection pool (e.g. lib/pq or
+// pgx/v5/stdlib) to the pgmigrate.Driver interface, for callers who don't
+// want to depend on pgx directly.
+package stdlib
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/wttw/pgmigrate"
+	"github.com/wttw/pgmigrate/internal/sqlshared"
+)
+
+type driver struct {
+	db   *sql.DB
+	conn *sql.Conn // set once AcquireLock has pinned a connection
+	x    sqlshared.SQLDB
+}
+
+// New returns a pgmigrate.Driver backed by db.
+func New(db *sql.DB) pgmigrate.Driver {
+	return driver{db: db, x: db}
+}
+
+// AcquireLock pins a single *sql.Conn from db for the life of the run -
+// pg_advisory_lock is session-scoped, so every later call (EnsureVersionTable,
+// CurrentVersion, History, Apply, ReleaseLock) must go through the returned
+// Driver rather than the original, or the lock and unlock could land on two
+// different connections from the pool.
+func (d driver) AcquireLock(ctx context.Context, key int64) (pgmigrate.Driver, error) {
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, `select pg_advisory_lock($1)`, key); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return driver{db: d.db, conn: conn, x: conn}, nil
+}
+
+func (d driver) ReleaseLock(ctx context.Context, key int64) error {
+	if d.conn == nil {
+		return fmt.Errorf("stdlib driver: ReleaseLock called without a connection pinned by AcquireLock")
+	}
+	_, err := d.conn.ExecContext(ctx, `select pg_advisory_unlock($1)`, key)
+	if cerr := d.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// asDB adapts d.x to sqlshared.DB - the version-table bookkeeping and SQL
+// below is shared with pgmigrate's built-in driver and drivers/pgx via the
+// sqlshared package, so there's one copy of it rather than three.
+func (d driver) asDB() sqlshared.DB {
+	return sqlshared.NewSQLDB(d.x)
+}
+
+func (d driver) EnsureVersionTable(ctx context.Context, table string, historyMode bool) error {
+	return sqlshared.EnsureVersionTable(ctx, d.asDB(), table, historyMode)
+}
+
+func (d driver) CurrentVersion(ctx context.Context, table string, historyMode bool) (int, error) {
+	return sqlshared.CurrentVersion(ctx, d.asDB(), table, historyMode)
+}
+
+func (d driver) History(ctx context.Context, table string) ([]pgmigrate.AppliedMigration, error) {
+	rows, err := sqlshared.History(ctx, d.asDB(), table)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]pgmigrate.AppliedMigration, len(rows))
+	for i, r := range rows {
+		history[i] = pgmigrate.AppliedMigration(r)
+	}
+	return history, nil
+}
+
+func (d driver) Apply(ctx context.Context, table string, historyMode bool, before, after int, mig pgmigrate.Migration, statements []string, noTx bool, direction, checksum string) error {
+	return sqlshared.Apply(ctx, d.asDB(), table, historyMode, before, after, mig.Version, mig.Filename, statements, noTx, direction, checksum)
+}
@@ -0,0 +1,79 @@
+package sqlshared
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// PgxConn is satisfied by *pgx.Conn, *pgxpool.Pool and pgx.Tx - anything
+// pgx.BeginFunc can run a transaction against, plus a direct Exec for
+// statements that must run outside one.
+type PgxConn interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// NewPgxDB adapts a pgx connection or pool to DB.
+func NewPgxDB(conn PgxConn) DB {
+	return pgxDB{conn}
+}
+
+// WrapPgxTx adapts an already-open pgx.Tx to Tx, for callers (such as
+// connDriver.applyGo) that need to run ReadVersion/RecordVersion inside a
+// transaction they're also using directly for something sqlshared doesn't
+// know about, e.g. a Go-based migration function.
+func WrapPgxTx(tx pgx.Tx) Tx {
+	return pgxTx{tx}
+}
+
+type pgxDB struct{ conn PgxConn }
+
+func (d pgxDB) BeginFunc(ctx context.Context, fn func(Tx) error) error {
+	return pgx.BeginFunc(ctx, d.conn, func(tx pgx.Tx) error {
+		return fn(pgxTx{tx})
+	})
+}
+
+func (d pgxDB) Exec(ctx context.Context, query string, args ...any) error {
+	_, err := d.conn.Exec(ctx, query, args...)
+	return err
+}
+
+type pgxTx struct{ tx pgx.Tx }
+
+func (t pgxTx) Exec(ctx context.Context, query string, args ...any) error {
+	_, err := t.tx.Exec(ctx, query, args...)
+	return err
+}
+
+func (t pgxTx) QueryRow(ctx context.Context, query string, args ...any) Row {
+	return pgxRow{t.tx.QueryRow(ctx, query, args...)}
+}
+
+func (t pgxTx) Query(ctx context.Context, query string, args ...any) (Rows, error) {
+	rows, err := t.tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgxRows{rows}, nil
+}
+
+type pgxRow struct{ row pgx.Row }
+
+func (r pgxRow) Scan(dest ...any) error {
+	err := r.row.Scan(dest...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNoRows
+	}
+	return err
+}
+
+type pgxRows struct{ rows pgx.Rows }
+
+func (r pgxRows) Next() bool            { return r.rows.Next() }
+func (r pgxRows) Scan(dest ...any) error { return r.rows.Scan(dest...) }
+func (r pgxRows) Err() error            { return r.rows.Err() }
+func (r pgxRows) Close()                { r.rows.Close() }
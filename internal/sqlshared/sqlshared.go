@@ -0,0 +1,214 @@
+// Package sqlshared holds the schema-version bookkeeping logic and SQL
+// shared by pgmigrate's built-in pgx-backed Driver (driver.go) and the
+// drivers/pgx and drivers/stdlib adapters, so the three don't each carry an
+// independent, hand-kept copy of the same queries. It's parameterized over
+// the minimal Tx/DB interfaces below instead of pgmigrate's Migration/Driver
+// types, since pgmigrate can't import drivers/pgx or drivers/stdlib (they
+// import pgmigrate) and this package is imported by all three - see pgx.go
+// and stdlib.go for the adapters each caller uses to satisfy DB.
+package sqlshared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNoRows is returned by a Row's Scan when the underlying query matched no
+// rows. Adapters normalize pgx.ErrNoRows/sql.ErrNoRows to this, so the logic
+// below doesn't need to know which client library is in use.
+var ErrNoRows = errors.New("sqlshared: no rows in result set")
+
+// Row is a single-row query result, e.g. *sql.Row or a pgx.Row wrapper.
+type Row interface {
+	Scan(dest ...any) error
+}
+
+// Rows is a multi-row query result, e.g. *sql.Rows or a pgx.Rows wrapper.
+type Rows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close()
+}
+
+// Tx is the minimal transaction capability EnsureVersionTable,
+// CurrentVersion, History and Apply need.
+type Tx interface {
+	Exec(ctx context.Context, query string, args ...any) error
+	QueryRow(ctx context.Context, query string, args ...any) Row
+	Query(ctx context.Context, query string, args ...any) (Rows, error)
+}
+
+// DB lets the helpers below run a function inside a transaction, and run a
+// statement directly outside one - the latter is needed for migrations that
+// opt out of transactions (e.g. CREATE INDEX CONCURRENTLY).
+type DB interface {
+	BeginFunc(ctx context.Context, fn func(Tx) error) error
+	Exec(ctx context.Context, query string, args ...any) error
+}
+
+// AppliedMigration mirrors pgmigrate.AppliedMigration's fields using only
+// primitives.
+type AppliedMigration struct {
+	Version          int
+	MigrationVersion int
+	Name             string
+	Checksum         string
+	AppliedAt        time.Time
+	ExecutionMS      int
+	Direction        string
+}
+
+// EnsureVersionTable creates table if it doesn't already exist, using the
+// single-row layout or, in historyMode, the append-only layout.
+func EnsureVersionTable(ctx context.Context, db DB, table string, historyMode bool) error {
+	if historyMode {
+		return db.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id SERIAL PRIMARY KEY,
+			version INTEGER NOT NULL,
+			migration_version INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			execution_ms INTEGER NOT NULL,
+			direction TEXT NOT NULL
+		)`, table))
+	}
+	return db.BeginFunc(ctx, func(tx Tx) error {
+		if err := tx.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY CONSTRAINT one_version CHECK(id = 1), version INTEGER NOT NULL)`, table)); err != nil {
+			return err
+		}
+		var count int
+		if err := tx.QueryRow(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s`, table)).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			// Table is already populated, so has been set up previously
+			return nil
+		}
+		return tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (id, version) VALUES (1, 0)`, table))
+	})
+}
+
+// CurrentVersion returns the schema version currently recorded in table.
+func CurrentVersion(ctx context.Context, db DB, table string, historyMode bool) (int, error) {
+	var version int
+	err := db.BeginFunc(ctx, func(tx Tx) error {
+		return ReadVersion(ctx, tx, table, historyMode, &version)
+	})
+	return version, err
+}
+
+// ReadVersion reads the current schema version within tx, regardless of
+// which of the two table layouts is in use.
+func ReadVersion(ctx context.Context, tx Tx, table string, historyMode bool, version *int) error {
+	if !historyMode {
+		return tx.QueryRow(ctx, fmt.Sprintf(`select version from %s`, table)).Scan(version)
+	}
+	err := tx.QueryRow(ctx, fmt.Sprintf(`select version from %s order by id desc limit 1`, table)).Scan(version)
+	if errors.Is(err, ErrNoRows) {
+		*version = 0
+		return nil
+	}
+	return err
+}
+
+// RecordVersion records that the schema is now at version after, within tx.
+// In historyMode it also records migrationVersion separately from after,
+// since for a down migration they differ (after is migrationVersion-1) and
+// Verify needs the migration's own version to know which migration the row
+// concerns.
+func RecordVersion(ctx context.Context, tx Tx, table string, historyMode bool, after, migrationVersion int, name, direction, checksum string, elapsed time.Duration) error {
+	if !historyMode {
+		return tx.Exec(ctx, fmt.Sprintf(`update %s set version = $1`, table), after)
+	}
+	return tx.Exec(ctx, fmt.Sprintf(`insert into %s (version, migration_version, name, checksum, execution_ms, direction) values ($1, $2, $3, $4, $5, $6)`, table),
+		after, migrationVersion, name, checksum, elapsed.Milliseconds(), direction)
+}
+
+// History returns every row of table, oldest first.
+func History(ctx context.Context, db DB, table string) ([]AppliedMigration, error) {
+	var history []AppliedMigration
+	err := db.BeginFunc(ctx, func(tx Tx) error {
+		rows, err := tx.Query(ctx, fmt.Sprintf(`select version, migration_version, name, checksum, applied_at, execution_ms, direction from %s order by id`, table))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var a AppliedMigration
+			if err := rows.Scan(&a.Version, &a.MigrationVersion, &a.Name, &a.Checksum, &a.AppliedAt, &a.ExecutionMS, &a.Direction); err != nil {
+				return err
+			}
+			history = append(history, a)
+		}
+		return rows.Err()
+	})
+	return history, err
+}
+
+// Apply runs statements against table, checking that the version currently
+// recorded there is before and recording it as after once done, under
+// migrationVersion/name/direction/checksum for History. Unless noTx is true,
+// this happens atomically in one transaction; when true (required for
+// statements such as CREATE INDEX CONCURRENTLY), the statements run outside
+// any transaction and the version bump is recorded in a second short
+// transaction once they succeed - with the expected version checked before
+// any statement runs, not just afterward, so a stale precondition is caught
+// before an irreversible statement has already executed.
+func Apply(ctx context.Context, db DB, table string, historyMode bool, before, after, migrationVersion int, name string, statements []string, noTx bool, direction, checksum string) error {
+	start := time.Now()
+	if noTx {
+		return applyNoTx(ctx, db, table, historyMode, before, after, migrationVersion, name, statements, direction, checksum, start)
+	}
+	return db.BeginFunc(ctx, func(tx Tx) error {
+		var current int
+		if err := ReadVersion(ctx, tx, table, historyMode, &current); err != nil {
+			return fmt.Errorf("while reading current version: %w", err)
+		}
+		if current != before {
+			return fmt.Errorf("expected current version %d, found %d", before, current)
+		}
+		for _, stmt := range statements {
+			if err := tx.Exec(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		if err := RecordVersion(ctx, tx, table, historyMode, after, migrationVersion, name, direction, checksum, time.Since(start)); err != nil {
+			return fmt.Errorf("while recording current version: %w", err)
+		}
+		return nil
+	})
+}
+
+func applyNoTx(ctx context.Context, db DB, table string, historyMode bool, before, after, migrationVersion int, name string, statements []string, direction, checksum string, start time.Time) error {
+	if err := db.BeginFunc(ctx, func(tx Tx) error {
+		var current int
+		if err := ReadVersion(ctx, tx, table, historyMode, &current); err != nil {
+			return fmt.Errorf("while reading current version: %w", err)
+		}
+		if current != before {
+			return fmt.Errorf("expected current version %d, found %d", before, current)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, stmt := range statements {
+		if err := db.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return db.BeginFunc(ctx, func(tx Tx) error {
+		var current int
+		if err := ReadVersion(ctx, tx, table, historyMode, &current); err != nil {
+			return fmt.Errorf("while reading current version: %w", err)
+		}
+		if current != before {
+			return fmt.Errorf("expected current version %d, found %d", before, current)
+		}
+		return RecordVersion(ctx, tx, table, historyMode, after, migrationVersion, name, direction, checksum, time.Since(start))
+	})
+}
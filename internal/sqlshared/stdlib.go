@@ -0,0 +1,74 @@
+package sqlshared
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// SQLDB is satisfied by *sql.DB and *sql.Conn - anything that can begin a
+// transaction and run a statement directly outside one.
+type SQLDB interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// NewSQLDB adapts a database/sql connection or pool to DB.
+func NewSQLDB(db SQLDB) DB {
+	return sqlDB{db}
+}
+
+type sqlDB struct{ db SQLDB }
+
+func (d sqlDB) BeginFunc(ctx context.Context, fn func(Tx) error) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := fn(sqlTx{tx}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d sqlDB) Exec(ctx context.Context, query string, args ...any) error {
+	_, err := d.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+type sqlTx struct{ tx *sql.Tx }
+
+func (t sqlTx) Exec(ctx context.Context, query string, args ...any) error {
+	_, err := t.tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (t sqlTx) QueryRow(ctx context.Context, query string, args ...any) Row {
+	return sqlRow{t.tx.QueryRowContext(ctx, query, args...)}
+}
+
+func (t sqlTx) Query(ctx context.Context, query string, args ...any) (Rows, error) {
+	rows, err := t.tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return sqlRows{rows}, nil
+}
+
+type sqlRow struct{ row *sql.Row }
+
+func (r sqlRow) Scan(dest ...any) error {
+	err := r.row.Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNoRows
+	}
+	return err
+}
+
+type sqlRows struct{ rows *sql.Rows }
+
+func (r sqlRows) Next() bool            { return r.rows.Next() }
+func (r sqlRows) Scan(dest ...any) error { return r.rows.Scan(dest...) }
+func (r sqlRows) Err() error            { return r.rows.Err() }
+func (r sqlRows) Close()                { _ = r.rows.Close() }
@@ -1,25 +1,62 @@
 package pgmigrate
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"hash/fnv"
 	"io/fs"
+	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 )
 
 const DefaultVersionTable = "schema_version"
 
 type Conn interface {
 	Begin(ctx context.Context) (pgx.Tx, error)
+	// Exec is used to run migrations that opt out of running inside a
+	// transaction. *pgx.Conn and *pgxpool.Pool both satisfy this already.
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
 }
 
+// GoFunc is the signature of a Go-based migration function registered with
+// RegisterGo, run inside the same transaction that bumps schema_version.
+type GoFunc func(ctx context.Context, tx pgx.Tx) error
+
 type Migration struct {
 	Version  int
 	Filename string
+	// Name and Go are set instead of Filename for migrations registered with
+	// RegisterGo.
+	Name string
+	Go   GoFunc
+}
+
+// displayName returns the name used to refer to this migration in error
+// messages and logs.
+func (m Migration) displayName() string {
+	if m.Filename != "" {
+		return m.Filename
+	}
+	return m.Name
+}
+
+// MigratorOptions controls optional behaviour of a Migrator.
+type MigratorOptions struct {
+	// DisableTx runs every migration outside a transaction, updating
+	// schema_version in a separate short transaction once the migration
+	// succeeds. Individual files can opt into this with a leading
+	// "-- pgmigrate:no-transaction" comment instead of setting this globally.
+	DisableTx bool
 }
 
 type Migrator struct {
@@ -27,6 +64,254 @@ type Migrator struct {
 	Filesystem   fs.FS
 	MigrateUp    []Migration
 	MigrateDown  []Migration
+	Options      MigratorOptions
+	// LockKey is the advisory lock key used to serialize Up/Down/To runs
+	// across concurrent processes. If zero, it is derived from VersionTable.
+	LockKey int64
+	// HistoryMode replaces the single-row VersionTable with an append-only
+	// history of every migration applied, including a checksum of its
+	// contents, so that drift in already-applied migrations can be detected.
+	HistoryMode bool
+	// Data is made available to every .sql migration as template data (see
+	// renderTemplate), letting operators parameterize migrations per
+	// environment without maintaining separate migration trees.
+	Data map[string]any
+	// Hooks, if set, are called around every migration Apply runs, for
+	// observability (logging, OpenTelemetry spans, Prometheus metrics) or
+	// gate-keeping.
+	Hooks Hooks
+}
+
+// Hooks are called by Apply around running each migration. Any of the three
+// may be left nil.
+type Hooks struct {
+	// BeforeApply is called before a migration runs. A non-nil error aborts
+	// the migration - and the Up/Down/To run it's part of - without
+	// applying anything, which can be used to gate destructive migrations
+	// behind e.g. a maintenance-mode flag.
+	BeforeApply func(mig Migration, direction string) error
+	// AfterApply is called once a migration has finished, successfully or
+	// not.
+	AfterApply func(mig Migration, direction string, elapsed time.Duration, err error)
+	// OnSQL is called with the fully rendered SQL about to be executed for
+	// a .sql migration. It is not called for Go-based migrations.
+	OnSQL func(mig Migration, sql string)
+}
+
+// templateContext is the root value migrations are rendered against, giving
+// them access to Migrator.Data plus a handful of helpers.
+type templateContext struct {
+	Data map[string]any
+}
+
+// EnvVar looks up an environment variable from within a migration template,
+// e.g. {{.EnvVar "FOO"}}.
+func (templateContext) EnvVar(name string) string {
+	return os.Getenv(name)
+}
+
+// renderTemplate runs a migration's SQL through text/template with .Data in
+// scope, e.g. so a tablespace name can be parameterized with
+// "TABLESPACE {{.Data.IndexTablespace}}". A template error aborts before any
+// SQL runs.
+func (m Migrator) renderTemplate(mig Migration, sql []byte) ([]byte, error) {
+	tmpl, err := template.New(mig.displayName()).Parse(string(sql))
+	if err != nil {
+		return nil, fmt.Errorf("while parsing migration template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, templateContext{Data: m.Data}); err != nil {
+		return nil, fmt.Errorf("while executing migration template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// AppliedMigration is one row of migration history, returned by History.
+type AppliedMigration struct {
+	// Version is the schema version the database was left at once this row
+	// was applied - for a down migration, that's MigrationVersion-1.
+	Version int
+	// MigrationVersion is the version of the migration this row applied or
+	// reverted, regardless of direction. Verify uses this, not Version, to
+	// track which migrations are currently applied.
+	MigrationVersion int
+	Name             string
+	Checksum         string
+	AppliedAt        time.Time
+	ExecutionMS      int
+	Direction        string
+}
+
+// ChecksumMismatchError is returned by Verify, and in HistoryMode by Up and
+// by To when it moves forward, when a migration that has already been
+// applied no longer hashes to the checksum recorded at the time it was
+// applied. Down, and To when it moves backward, run no such check.
+type ChecksumMismatchError struct {
+	Version  int
+	Filename string
+	Stored   string
+	Current  string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for migration %d (%s): stored %s, found %s", e.Version, e.Filename, e.Stored, e.Current)
+}
+
+// checksumOf computes the checksum recorded for a migration in HistoryMode.
+// Go-based migrations have no file contents to hash, so their name is hashed
+// instead.
+func checksumOf(mig Migration, sql []byte) string {
+	sum := sha256.New()
+	if mig.Go != nil {
+		sum.Write([]byte(mig.Name))
+	} else {
+		sum.Write(sql)
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// lockKey returns LockKey if set, otherwise a key derived from VersionTable
+// so that migrators sharing a version table also share an advisory lock.
+func (m Migrator) lockKey() int64 {
+	if m.LockKey != 0 {
+		return m.LockKey
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(m.VersionTable))
+	return int64(h.Sum64())
+}
+
+// acquireAdvisoryLock begins a transaction against db and blocks until it
+// holds the advisory lock identified by key, returning that transaction.
+// It's the one implementation of the lock/unlock SQL shared by
+// Migrator.Lock and connDriver.AcquireLock (driver.go).
+func acquireAdvisoryLock(ctx context.Context, db Conn, key int64) (pgx.Tx, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `select pg_advisory_lock($1)`, key); err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, err
+	}
+	return tx, nil
+}
+
+// tryAcquireAdvisoryLock is the non-blocking equivalent of
+// acquireAdvisoryLock, shared by Migrator.TryLock and
+// connDriver.tryAcquireLock (driver.go).
+func tryAcquireAdvisoryLock(ctx context.Context, db Conn, key int64) (tx pgx.Tx, ok bool, err error) {
+	tx, err = db.Begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := tx.QueryRow(ctx, `select pg_try_advisory_lock($1)`, key).Scan(&ok); err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, false, err
+	}
+	if !ok {
+		_ = tx.Rollback(ctx)
+		return nil, false, nil
+	}
+	return tx, true, nil
+}
+
+// releaseAdvisoryLock releases a lock acquired by acquireAdvisoryLock or
+// tryAcquireAdvisoryLock, shared by Migrator.Unlock and
+// connDriver.ReleaseLock (driver.go).
+func releaseAdvisoryLock(ctx context.Context, tx pgx.Tx, key int64) error {
+	_, err := tx.Exec(ctx, `select pg_advisory_unlock($1)`, key)
+	if cerr := tx.Commit(ctx); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Lock acquires the Migrator's advisory lock directly against db, blocking
+// until it is available. It's an exported primitive for callers building
+// their own migration flow around Apply - Up, Down, To and UpTryLock don't
+// call it; they acquire the same lock via Driver.AcquireLock (UpTryLock via
+// connDriver's non-blocking equivalent) and release it via
+// Driver.ReleaseLock (driver.go) instead, sharing the lock/unlock SQL through
+// acquireAdvisoryLock/releaseAdvisoryLock above. The returned transaction
+// must be passed to Unlock once the migration run is complete.
+func (m Migrator) Lock(ctx context.Context, db Conn) (pgx.Tx, error) {
+	tx, err := acquireAdvisoryLock(ctx, db, m.lockKey())
+	if err != nil {
+		return nil, fmt.Errorf("while acquiring advisory lock: %w", err)
+	}
+	return tx, nil
+}
+
+// TryLock attempts to acquire the Migrator's advisory lock without blocking.
+// It returns ok=false if another process already holds it, which lets
+// sidecars and secondary instances no-op cleanly instead of waiting. Like
+// Lock, this is a standalone primitive - UpTryLock goes through
+// connDriver's non-blocking equivalent instead, sharing the same SQL.
+func (m Migrator) TryLock(ctx context.Context, db Conn) (tx pgx.Tx, ok bool, err error) {
+	tx, ok, err = tryAcquireAdvisoryLock(ctx, db, m.lockKey())
+	if err != nil {
+		return nil, false, fmt.Errorf("while acquiring advisory lock: %w", err)
+	}
+	return tx, ok, nil
+}
+
+// Unlock releases an advisory lock acquired by Lock or TryLock. Up/Down/To
+// release theirs via Driver.ReleaseLock instead, which shares this same SQL.
+func (m Migrator) Unlock(ctx context.Context, tx pgx.Tx) error {
+	if err := releaseAdvisoryLock(ctx, tx, m.lockKey()); err != nil {
+		return fmt.Errorf("while releasing advisory lock: %w", err)
+	}
+	return nil
+}
+
+// directiveNoTransaction, at the top of a .sql file, runs that migration
+// outside a transaction - required for statements such as
+// CREATE INDEX CONCURRENTLY that Postgres refuses to run inside one.
+const directiveNoTransaction = "pgmigrate:no-transaction"
+
+// directiveSplit, at the top of a .sql file, splits it on ";" and executes
+// each statement individually, so a single failing statement (e.g. a failed
+// CONCURRENTLY index) doesn't abort the whole batch ambiguously.
+const directiveSplit = "pgmigrate:split"
+
+// parseDirectives reads the leading "--" comment lines of a migration file
+// looking for pgmigrate directives.
+func parseDirectives(sql []byte) (noTransaction, split bool) {
+	for _, line := range strings.Split(string(sql), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if !strings.HasPrefix(trimmed, "--") {
+			break
+		}
+		switch strings.TrimSpace(strings.TrimPrefix(trimmed, "--")) {
+		case directiveNoTransaction:
+			noTransaction = true
+		case directiveSplit:
+			split = true
+		}
+	}
+	return noTransaction, split
+}
+
+// RegisterGo registers a Go-based migration for version on m, alongside its
+// SQL file migrations. This allows data migrations that need conditional
+// logic, backfills, or transforms that pure SQL can't express.
+//
+// RegisterGo must be called before m is used to run migrations, since it
+// re-validates the combined Up/Down sequence the same way New does. It is
+// not safe to call concurrently with itself or with a migration run.
+func (m *Migrator) RegisterGo(version int, name string, up, down GoFunc) error {
+	if up == nil {
+		return fmt.Errorf("RegisterGo: up migration for version %d (%s) must not be nil", version, name)
+	}
+	m.MigrateUp = append(m.MigrateUp, Migration{Version: version, Name: name, Go: up})
+	if down != nil {
+		m.MigrateDown = append(m.MigrateDown, Migration{Version: version, Name: name, Go: down})
+	}
+	return m.validate()
 }
 
 // Migrate updates the target db using patches found in filesystem using DefaultVersionTable
@@ -82,34 +367,45 @@ func newMigrator(filesystem fs.FS, strict bool) (Migrator, error) {
 			m.MigrateDown = append(m.MigrateDown, mig)
 		}
 	}
+	if err := m.validate(); err != nil {
+		return Migrator{}, err
+	}
+	return m, nil
+}
+
+// validate sorts MigrateUp/MigrateDown by version and checks that they form
+// a contiguous 1..n sequence with matching up/down filenames. It's called by
+// newMigrator and again by RegisterGo, since appending a Go-based migration
+// can change the sequence.
+func (m *Migrator) validate() error {
 	sort.Slice(m.MigrateUp, func(i, j int) bool {
 		return m.MigrateUp[i].Version < m.MigrateUp[j].Version
 	})
 	for i, v := range m.MigrateUp {
 		if v.Version != i+1 {
-			return Migrator{}, fmt.Errorf("unexpected sequence - found %s at %d", v.Filename, i+1)
+			return fmt.Errorf("unexpected sequence - found %s at %d", v.displayName(), i+1)
 		}
 	}
 	if m.MigrateDown == nil {
-		return m, nil
+		return nil
 	}
 	sort.Slice(m.MigrateDown, func(i, j int) bool {
 		return m.MigrateDown[i].Version < m.MigrateDown[j].Version
 	})
 	if len(m.MigrateUp) != len(m.MigrateDown) {
-		return Migrator{}, fmt.Errorf("%d up scripts vs %d down scripts", len(m.MigrateUp), len(m.MigrateDown))
+		return fmt.Errorf("%d up scripts vs %d down scripts", len(m.MigrateUp), len(m.MigrateDown))
 	}
 	for i, v := range m.MigrateDown {
 		if v.Version != i+1 {
-			return Migrator{}, fmt.Errorf("unexpected sequence - found %s at %d", v.Filename, i+1)
+			return fmt.Errorf("unexpected sequence - found %s at %d", v.displayName(), i+1)
 		}
 	}
 	for i, v := range m.MigrateUp {
 		if strings.TrimSuffix(v.Filename, ".up.sql") != strings.TrimSuffix(m.MigrateDown[i].Filename, ".down.sql") {
-			return Migrator{}, fmt.Errorf("up/down mismatch: %s, %s", v.Filename, m.MigrateDown[i].Filename)
+			return fmt.Errorf("up/down mismatch: %s, %s", v.Filename, m.MigrateDown[i].Filename)
 		}
 	}
-	return m, nil
+	return nil
 }
 
 // Latest returns the highest schema version available
@@ -120,94 +416,99 @@ func (m Migrator) Latest() int {
 	return m.MigrateUp[len(m.MigrateUp)-1].Version
 }
 
-// Current returns the current schema version in a database
+// Current returns the current schema version in a database.
 func (m Migrator) Current(ctx context.Context, db Conn) (int, error) {
-	err := m.initializeSchemaVersion(ctx, db)
-	if err != nil {
-		return 0, err
-	}
-	var version int
-	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
-		return tx.QueryRow(ctx, fmt.Sprintf(`select version from %s`, m.VersionTable)).Scan(&version)
-	})
-	if err != nil {
-		return 0, fmt.Errorf("failed to retrieve current schema version: %w", err)
-	}
-	return version, nil
+	return m.currentDriver(ctx, connDriver{db: db})
 }
 
-func (m Migrator) Apply(ctx context.Context, db Conn, before, after int, filename string) error {
-	sql, err := fs.ReadFile(m.Filesystem, filename)
-	if err != nil {
-		return fmt.Errorf("while reading patch file: %w", err)
-	}
-	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
-		var current int
-		err := tx.QueryRow(ctx, fmt.Sprintf(`select version from %s`, m.VersionTable)).Scan(&current)
-		if err != nil {
-			return fmt.Errorf("while reading current version: %w", err)
-		}
-		if current != before {
-			return fmt.Errorf("expected current version %d, found %d", before, current)
-		}
-		_, err = tx.Exec(ctx, fmt.Sprintf(`update %s set version = $1`, m.VersionTable), after)
-		if err != nil {
-			return fmt.Errorf("while updating current version: %w", err)
-		}
-		_, err = tx.Exec(ctx, string(sql))
-		if err != nil {
-			return err
-		}
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("while applying %s: %w", filename, err)
-	}
-	return nil
+// Apply applies a single migration against db, running the Hooks around it.
+// It's exposed mainly for callers driving their own Up/Down loop instead of
+// Up/Down/To; Apply itself doesn't take the advisory lock.
+func (m Migrator) Apply(ctx context.Context, db Conn, before, after int, mig Migration) error {
+	return m.applyDriver(ctx, connDriver{db: db}, before, after, mig)
 }
 
-// Up updates the database schema to the newest version
+// Up updates the database schema to the newest version. The run is
+// serialized against other processes via an advisory lock (see LockKey).
+//
+// The migrations themselves run on the same connection/transaction that
+// holds the lock, rather than checking out a second connection from db -
+// otherwise a pool sized to exactly one connection (a common setup for a
+// one-shot migration job) would deadlock, since the lock would never free
+// up the connection a second query needs.
 func (m Migrator) Up(ctx context.Context, db Conn) error {
-	current, err := m.Current(ctx, db)
+	return m.UpDriver(ctx, connDriver{db: db})
+}
+
+// UpTryLock behaves like Up, but returns immediately with ok=false instead
+// of blocking if another process already holds the advisory lock. This lets
+// sidecars and secondary instances no-op cleanly instead of racing.
+func (m Migrator) UpTryLock(ctx context.Context, db Conn) (ok bool, err error) {
+	locked, ok, err := connDriver{db: db}.tryAcquireLock(ctx, m.lockKey())
 	if err != nil {
-		return err
+		return false, fmt.Errorf("while acquiring advisory lock: %w", err)
 	}
-	for _, v := range m.MigrateUp {
-		if current >= v.Version {
-			continue
-		}
-		err := m.Apply(ctx, db, current, v.Version, v.Filename)
-		if err != nil {
-			return fmt.Errorf("failed to apply %s: %w", v.Filename, err)
-		}
-		current = v.Version
+	if !ok {
+		return false, nil
 	}
-	return nil
+	defer func() { _ = locked.ReleaseLock(ctx, m.lockKey()) }()
+	return true, m.upDriver(ctx, locked)
 }
 
-func (m Migrator) initializeSchemaVersion(ctx context.Context, db Conn) error {
-	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
-		_, err := tx.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY CONSTRAINT one_version CHECK(id = 1), version INTEGER NOT NULL)`, m.VersionTable))
-		if err != nil {
-			return err
-		}
-		var count int
-		err = tx.QueryRow(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s`, m.VersionTable)).Scan(&count)
-		if err != nil {
-			return err
-		}
-		if count > 0 {
-			// Table is already populated, so has been set up previously
-			return nil
+// Down rolls the database schema back to target, applying down migrations in
+// descending order from the current version. The run is serialized against
+// other processes via an advisory lock (see LockKey).
+//
+// As with Up, the migrations run on the connection/transaction holding the
+// lock rather than a second one checked out from db, so this doesn't
+// deadlock against a pool sized to a single connection.
+func (m Migrator) Down(ctx context.Context, db Conn, target int) error {
+	return m.DownDriver(ctx, connDriver{db: db}, target)
+}
+
+// To migrates the database schema to target, applying up or down migrations
+// as needed depending on the current version. The run is serialized against
+// other processes via an advisory lock (see LockKey).
+//
+// As with Up, the migrations run on the connection/transaction holding the
+// lock rather than a second one checked out from db, so this doesn't
+// deadlock against a pool sized to a single connection.
+func (m Migrator) To(ctx context.Context, db Conn, target int) error {
+	return m.ToDriver(ctx, connDriver{db: db}, target)
+}
+
+// Plan returns the ordered list of migrations that would be executed to move
+// from current to target, without touching the database. This is useful for
+// CI diffs and dry-run tooling.
+func (m Migrator) Plan(current, target int) []Migration {
+	var plan []Migration
+	if target < current {
+		for i := len(m.MigrateDown) - 1; i >= 0; i-- {
+			v := m.MigrateDown[i]
+			if v.Version <= current && v.Version > target {
+				plan = append(plan, v)
+			}
 		}
-		_, err = tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (id, version) VALUES (1, 0)`, m.VersionTable))
-		if err != nil {
-			return err
+		return plan
+	}
+	for _, v := range m.MigrateUp {
+		if v.Version > current && v.Version <= target {
+			plan = append(plan, v)
 		}
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("while creating version table %s: %w", m.VersionTable, err)
 	}
-	return nil
+	return plan
+}
+
+// History returns every migration applied to db, oldest first, when
+// HistoryMode is enabled. Without HistoryMode it returns an error.
+func (m Migrator) History(ctx context.Context, db Conn) ([]AppliedMigration, error) {
+	return m.historyDriver(ctx, connDriver{db: db})
+}
+
+// Verify checks that every migration already applied to db still matches
+// the checksum recorded when it was applied, returning a
+// *ChecksumMismatchError for the first mismatch found. It is a no-op unless
+// HistoryMode is enabled.
+func (m Migrator) Verify(ctx context.Context, db Conn) error {
+	return m.verifyDriver(ctx, connDriver{db: db})
 }
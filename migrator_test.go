@@ -0,0 +1,145 @@
+package pgmigrate
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func migrations(versions ...int) []Migration {
+	migs := make([]Migration, len(versions))
+	for i, v := range versions {
+		migs[i] = Migration{Version: v, Filename: "migration"}
+	}
+	return migs
+}
+
+func TestPlan(t *testing.T) {
+	m := Migrator{
+		MigrateUp:   migrations(1, 2, 3),
+		MigrateDown: migrations(1, 2, 3),
+	}
+
+	cases := []struct {
+		name            string
+		current, target int
+		want            []int
+	}{
+		{"up from zero", 0, 3, []int{1, 2, 3}},
+		{"up partial", 1, 2, []int{2}},
+		{"up no-op", 3, 3, nil},
+		{"down to zero", 3, 0, []int{3, 2, 1}},
+		{"down partial", 3, 1, []int{3, 2}},
+		{"down no-op", 1, 1, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			plan := m.Plan(c.current, c.target)
+			var got []int
+			for _, v := range plan {
+				got = append(got, v.Version)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Plan(%d, %d) = %v, want %v", c.current, c.target, got, c.want)
+			}
+		})
+	}
+}
+
+func noopGoFunc(context.Context, pgx.Tx) error { return nil }
+
+func TestRegisterGo(t *testing.T) {
+	t.Run("rejects a nil up migration", func(t *testing.T) {
+		m := &Migrator{MigrateUp: migrations(1)}
+		err := m.RegisterGo(2, "backfill", nil, noopGoFunc)
+		if err == nil {
+			t.Fatal("RegisterGo with a nil up migration should have failed")
+		}
+	})
+
+	t.Run("appends in sequence with no down migration", func(t *testing.T) {
+		m := &Migrator{MigrateUp: migrations(1)}
+		if err := m.RegisterGo(2, "backfill", noopGoFunc, nil); err != nil {
+			t.Fatalf("RegisterGo failed: %v", err)
+		}
+		if len(m.MigrateUp) != 2 || len(m.MigrateDown) != 0 {
+			t.Fatalf("got %d up / %d down migrations, want 2 up / 0 down", len(m.MigrateUp), len(m.MigrateDown))
+		}
+	})
+
+	t.Run("rejects an out-of-sequence version", func(t *testing.T) {
+		m := &Migrator{MigrateUp: migrations(1)}
+		if err := m.RegisterGo(3, "backfill", noopGoFunc, nil); err == nil {
+			t.Fatal("RegisterGo with a gap in the version sequence should have failed")
+		}
+	})
+}
+
+func TestParseDirectives(t *testing.T) {
+	cases := []struct {
+		name                string
+		sql                 string
+		wantNoTx, wantSplit bool
+	}{
+		{"no directives", "create table foo (id int);", false, false},
+		{"no-transaction", "-- pgmigrate:no-transaction\ncreate index concurrently foo_idx on foo (id);", true, false},
+		{"split", "-- pgmigrate:split\ncreate table foo (id int);\ncreate table bar (id int);", false, true},
+		{"both, with a blank line and an unrelated comment between them", "-- pgmigrate:no-transaction\n\n-- a normal comment\n-- pgmigrate:split\ncreate table foo (id int);", true, true},
+		{"directive after the leading comment block is ignored", "create table foo (id int);\n-- pgmigrate:no-transaction\n", false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			noTx, split := parseDirectives([]byte(c.sql))
+			if noTx != c.wantNoTx || split != c.wantSplit {
+				t.Errorf("parseDirectives(%q) = (%v, %v), want (%v, %v)", c.sql, noTx, split, c.wantNoTx, c.wantSplit)
+			}
+		})
+	}
+}
+
+func TestChecksumOf(t *testing.T) {
+	t.Run("hashes the file contents for a file-based migration", func(t *testing.T) {
+		mig := Migration{Version: 1, Filename: "1_foo.up.sql"}
+		if checksumOf(mig, []byte("create table foo();")) != checksumOf(mig, []byte("create table foo();")) {
+			t.Error("checksumOf should be deterministic for identical SQL")
+		}
+		if checksumOf(mig, []byte("create table foo();")) == checksumOf(mig, []byte("create table bar();")) {
+			t.Error("checksumOf should differ when the file contents change, or drift wouldn't be detected")
+		}
+	})
+
+	t.Run("hashes the name, not sql, for a Go-based migration", func(t *testing.T) {
+		mig := Migration{Version: 1, Name: "backfill", Go: noopGoFunc}
+		if checksumOf(mig, nil) != checksumOf(mig, []byte("ignored")) {
+			t.Error("checksumOf should ignore sql for a Go-based migration")
+		}
+		other := Migration{Version: 1, Name: "other-backfill", Go: noopGoFunc}
+		if checksumOf(mig, nil) == checksumOf(other, nil) {
+			t.Error("checksumOf should differ when a Go-based migration's name changes")
+		}
+	})
+}
+
+func TestRenderTemplate(t *testing.T) {
+	m := Migrator{Data: map[string]any{"IndexTablespace": "fast_ssd"}}
+	mig := Migration{Version: 1, Filename: "1_foo.up.sql"}
+
+	t.Run("substitutes .Data into the template", func(t *testing.T) {
+		out, err := m.renderTemplate(mig, []byte("create index foo_idx on foo (id) TABLESPACE {{.Data.IndexTablespace}};"))
+		if err != nil {
+			t.Fatalf("renderTemplate failed: %v", err)
+		}
+		want := "create index foo_idx on foo (id) TABLESPACE fast_ssd;"
+		if string(out) != want {
+			t.Errorf("renderTemplate() = %q, want %q", out, want)
+		}
+	})
+
+	t.Run("aborts on a malformed template instead of running partial SQL", func(t *testing.T) {
+		if _, err := m.renderTemplate(mig, []byte("create table foo ({{.Data.Missing")); err == nil {
+			t.Fatal("renderTemplate with an unclosed action should have failed")
+		}
+	})
+}